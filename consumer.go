@@ -3,9 +3,20 @@
 package loggregator_consumer
 
 import (
+	"bufio"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.net/websocket"
@@ -17,25 +28,120 @@ import (
 // server to keep the websocket connection alive.
 var KeepAlive = 25 * time.Second
 
+// HandshakeTimeout bounds how long dialing and the websocket handshake
+// (including any proxy CONNECT tunnel and TLS negotiation) may take before
+// the attempt is abandoned.
+var HandshakeTimeout = 10 * time.Second
+
+// ReadTimeout bounds how long Tail will wait for a message before treating
+// the connection as dead. Zero disables the deadline.
+var ReadTimeout = 30 * time.Second
+
+// ErrTimeout is sent on the error channel returned by Tail when a read
+// exceeds ReadTimeout.
+var ErrTimeout = errors.New("loggregator_consumer: read timeout")
+
+const (
+	initialReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay     = 30 * time.Second
+
+	// stableConnectionThreshold is how long a connection must stay up
+	// before a subsequent disconnect resets the backoff delay, rather than
+	// continuing to grow it.
+	stableConnectionThreshold = initialReconnectDelay
+)
+
 // LoggregatorConnection represents a connection to a loggregator server.
 type LoggregatorConnection interface {
 	Tail(appGuid string, authToken string) (<-chan *logmessage.LogMessage, <-chan error)
+	TailFiltered(appGuid string, authToken string, filter Filter) (<-chan *logmessage.LogMessage, <-chan error)
+	Recent(appGuid string, authToken string) ([]*logmessage.LogMessage, error)
+	SetOnConnectCallback(func())
 	Close() error
 }
 
+// Filter restricts the messages delivered by TailFiltered to those matching
+// all of its non-empty/non-nil fields. It is applied client-side after
+// protobuf decode, so it works against any loggregator server regardless of
+// which server-side filters it understands. Each entry in SourceNames is
+// also sent to the server as a repeated source_type query parameter, for
+// servers that support filtering before the data even reaches the client.
+type Filter struct {
+	MessageTypes   []logmessage.LogMessage_MessageType
+	SourceNames    []string
+	SourceInstance *string
+}
+
+func (f *Filter) matches(message *logmessage.LogMessage) bool {
+	if len(f.MessageTypes) > 0 {
+		found := false
+		for _, messageType := range f.MessageTypes {
+			if message.GetMessageType() == messageType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.SourceNames) > 0 {
+		found := false
+		for _, sourceName := range f.SourceNames {
+			if message.GetSourceName() == sourceName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.SourceInstance != nil && message.GetSourceId() != *f.SourceInstance {
+		return false
+	}
+
+	return true
+}
+
 type connection struct {
-	endpoint    string
-	tlsConfig   *tls.Config
-	proxy       interface{}
-	ws          *websocket.Conn
+	endpoint     string
+	tlsConfig    *tls.Config
+	proxy        func(*http.Request) (*url.URL, error)
+	wsMu         sync.Mutex
+	ws           *websocket.Conn
 	incomingChan chan *logmessage.LogMessage
 	errChan      chan error
+	onConnect    func()
+	stopChan     chan struct{}
+	closeOnce    sync.Once
+	started      bool
+	filter       *Filter
+}
+
+// setWS records the websocket currently in use by listen, guarded by wsMu
+// since Close reads it from a different goroutine.
+func (c *connection) setWS(ws *websocket.Conn) {
+	c.wsMu.Lock()
+	c.ws = ws
+	c.wsMu.Unlock()
+}
+
+func (c *connection) currentWS() *websocket.Conn {
+	c.wsMu.Lock()
+	defer c.wsMu.Unlock()
+	return c.ws
 }
 
 // NewConnection creates a new connection to a loggregator server at the
-// given endpoint. The tlsConfig is used when dialing over wss. The proxy
-// argument is currently unused.
-func NewConnection(endpoint string, tlsConfig *tls.Config, proxy interface{}) LoggregatorConnection {
+// given endpoint. The tlsConfig is used when dialing over wss/https. proxy
+// determines the proxy to use for both the Tail websocket and the Recent
+// HTTP request, in the same style as http.Transport.Proxy (pass
+// http.ProxyFromEnvironment to honor HTTP_PROXY/HTTPS_PROXY, or nil to
+// connect directly).
+func NewConnection(endpoint string, tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error)) LoggregatorConnection {
 	return &connection{
 		endpoint:  endpoint,
 		tlsConfig: tlsConfig,
@@ -43,29 +149,112 @@ func NewConnection(endpoint string, tlsConfig *tls.Config, proxy interface{}) Lo
 	}
 }
 
+// SetOnConnectCallback registers a function to be called every time Tail
+// establishes (or re-establishes) a connection to the loggregator server.
+func (c *connection) SetOnConnectCallback(cb func()) {
+	c.onConnect = cb
+}
+
 func (c *connection) Tail(appGuid string, authToken string) (<-chan *logmessage.LogMessage, <-chan error) {
+	return c.tail(appGuid, authToken, nil)
+}
+
+// TailFiltered behaves like Tail but only delivers messages matching filter.
+func (c *connection) TailFiltered(appGuid string, authToken string, filter Filter) (<-chan *logmessage.LogMessage, <-chan error) {
+	return c.tail(appGuid, authToken, &filter)
+}
+
+func (c *connection) tail(appGuid string, authToken string, filter *Filter) (<-chan *logmessage.LogMessage, <-chan error) {
 	c.incomingChan = make(chan *logmessage.LogMessage)
 	c.errChan = make(chan error)
+	c.stopChan = make(chan struct{})
+	c.started = true
+	c.filter = filter
 
 	go c.listen(appGuid, authToken)
 
 	return c.incomingChan, c.errChan
 }
 
+// listen dials the loggregator server and reads messages until Close is
+// called, transparently reconnecting with an exponential backoff whenever
+// the server closes the connection or it cannot be reached.
 func (c *connection) listen(appGuid string, authToken string) {
 	defer close(c.incomingChan)
 	defer close(c.errChan)
 
+	delay := initialReconnectDelay
+
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		default:
+		}
+
+		ws, err := c.connect(appGuid, authToken)
+		if err != nil {
+			c.errChan <- err
+			if !c.backoff(delay) {
+				return
+			}
+			delay = nextReconnectDelay(delay)
+			continue
+		}
+
+		c.setWS(ws)
+
+		select {
+		case <-c.stopChan:
+			ws.Close()
+			return
+		default:
+		}
+
+		if c.onConnect != nil {
+			c.onConnect()
+		}
+
+		go c.keepAlive(ws)
+		connectedAt := time.Now()
+		c.readLoop(ws)
+		ws.Close()
+
+		select {
+		case <-c.stopChan:
+			return
+		default:
+		}
+
+		if time.Since(connectedAt) >= stableConnectionThreshold {
+			delay = initialReconnectDelay
+		} else {
+			delay = nextReconnectDelay(delay)
+		}
+
+		if !c.backoff(delay) {
+			return
+		}
+	}
+}
+
+// connect performs a single dial attempt against the loggregator server.
+func (c *connection) connect(appGuid string, authToken string) (*websocket.Conn, error) {
 	scheme := "ws"
 	if c.tlsConfig != nil {
 		scheme = "wss"
 	}
 
-	url := fmt.Sprintf("%s://%s/tail/?app=%s", scheme, c.endpoint, appGuid)
-	config, err := websocket.NewConfig(url, "http://localhost")
+	tailURL := fmt.Sprintf("%s://%s/tail/?app=%s", scheme, c.endpoint, appGuid)
+	if c.filter != nil {
+		for _, sourceName := range c.filter.SourceNames {
+			tailURL += "&source_type=" + url.QueryEscape(sourceName)
+		}
+	}
+
+	config, err := websocket.NewConfig(tailURL, "http://localhost")
 	if err != nil {
-		c.errChan <- err
-		return
+		return nil, err
 	}
 
 	if authToken != "" {
@@ -76,20 +265,38 @@ func (c *connection) listen(appGuid string, authToken string) {
 		config.TlsConfig = c.tlsConfig
 	}
 
-	ws, err := websocket.DialConfig(config)
+	deadline := time.Now().Add(HandshakeTimeout)
+
+	netConn, err := c.dialNetConn(config, deadline)
 	if err != nil {
-		c.errChan <- err
-		return
+		return nil, err
 	}
 
-	c.ws = ws
+	netConn.SetDeadline(deadline)
+	ws, err := websocket.NewClient(config, netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
 
-	go c.keepAlive()
+	return ws, nil
+}
 
+// readLoop decodes messages off ws until the connection drops, at which
+// point it returns so listen can attempt a reconnect.
+func (c *connection) readLoop(ws *websocket.Conn) {
 	for {
+		if ReadTimeout > 0 {
+			ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+		}
+
 		var data []byte
 		err := websocket.Message.Receive(ws, &data)
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				c.errChan <- ErrTimeout
+			}
 			return
 		}
 
@@ -100,26 +307,247 @@ func (c *connection) listen(appGuid string, authToken string) {
 			continue
 		}
 
+		if c.filter != nil && !c.filter.matches(message) {
+			continue
+		}
+
 		c.incomingChan <- message
 	}
 }
 
-func (c *connection) keepAlive() {
+// backoff sleeps for d plus jitter, returning false if Close was called
+// during the wait.
+func (c *connection) backoff(d time.Duration) bool {
+	jitter := time.Duration(rand.Int63n(int64(d)/2 + 1))
+
+	select {
+	case <-time.After(d + jitter):
+		return true
+	case <-c.stopChan:
+		return false
+	}
+}
+
+func nextReconnectDelay(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxReconnectDelay {
+		d = maxReconnectDelay
+	}
+
+	return d
+}
+
+// dialNetConn establishes the raw (and, for wss, TLS) connection the
+// websocket handshake is performed over, routing through c.proxy when one
+// is configured. deadline bounds the whole dial, including any proxy
+// CONNECT tunnel and TLS handshake.
+func (c *connection) dialNetConn(config *websocket.Config, deadline time.Time) (net.Conn, error) {
+	host := config.Location.Host
+
+	var proxyURL *url.URL
+	if c.proxy != nil {
+		var err error
+		proxyURL, err = c.proxy(&http.Request{URL: httpSchemeURL(config.Location)})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL != nil {
+		conn, err = c.dialProxy(proxyURL, host, deadline)
+	} else {
+		conn, err = net.DialTimeout("tcp", host, HandshakeTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TlsConfig != nil {
+		conn.SetDeadline(deadline)
+		tlsConn := tls.Client(conn, tlsConfigForHost(config.TlsConfig, host))
+		if err := tlsConn.Handshake(); err != nil {
+			tlsConn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	return conn, nil
+}
+
+// httpSchemeURL returns a copy of u with its ws/wss scheme mapped to
+// http/https, the scheme http.ProxyFromEnvironment (and proxy funcs in
+// general) expect when deciding whether to consult HTTP_PROXY or
+// HTTPS_PROXY.
+func httpSchemeURL(u *url.URL) *url.URL {
+	mapped := *u
+	switch u.Scheme {
+	case "wss":
+		mapped.Scheme = "https"
+	case "ws":
+		mapped.Scheme = "http"
+	}
+	return &mapped
+}
+
+// tlsConfigForHost returns cfg, or a shallow clone of it with ServerName set
+// to host's hostname when cfg.ServerName is empty. tls.DialWithDialer does
+// the same thing for a direct dial; since we hand-roll the dial to support
+// proxying, we need to replicate it ourselves so certificate hostname
+// verification still works.
+func tlsConfigForHost(cfg *tls.Config, host string) *tls.Config {
+	if cfg.ServerName != "" {
+		return cfg
+	}
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	clone := *cfg
+	clone.ServerName = hostname
+	return &clone
+}
+
+// dialProxy opens a tunnel to host through the given proxy using the HTTP
+// CONNECT method, propagating proxy authentication from the proxy URL's
+// userinfo when present. The returned connection is a plain TCP stream;
+// callers are responsible for layering TLS on top when dialing a wss
+// endpoint.
+func (c *connection) dialProxy(proxyURL *url.URL, host string, deadline time.Time) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(deadline)
+
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("loggregator_consumer: proxy refused CONNECT: %s", response.Status)
+	}
+
+	return conn, nil
+}
+
+func (c *connection) keepAlive(ws *websocket.Conn) {
 	for {
 		time.Sleep(KeepAlive)
-		if c.ws == nil {
+		if _, err := ws.Write([]byte{}); err != nil {
 			return
 		}
-		if _, err := c.ws.Write([]byte{}); err != nil {
-			return
+	}
+}
+
+// Recent fetches the historical logs for an application from the
+// loggregator's /recent HTTP dump endpoint, as an alternative to the
+// live-tailing websocket.
+func (c *connection) Recent(appGuid string, authToken string) ([]*logmessage.LogMessage, error) {
+	scheme := "http"
+	if c.tlsConfig != nil {
+		scheme = "https"
+	}
+
+	url := fmt.Sprintf("%s://%s/recent?app=%s", scheme, c.endpoint, appGuid)
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if authToken != "" {
+		request.Header.Set("Authorization", authToken)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           c.proxy,
+			TLSClientConfig: c.tlsConfig,
+		},
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("loggregator_consumer: server returned %d from /recent", response.StatusCode)
+	}
+
+	_, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := multipart.NewReader(response.Body, params["boundary"])
+
+	messages := []*logmessage.LogMessage{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
 		}
+
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+
+		message := &logmessage.LogMessage{}
+		if err := proto.Unmarshal(data, message); err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
 	}
+
+	return messages, nil
 }
 
 func (c *connection) Close() error {
-	if c.ws == nil {
+	if !c.started {
 		return errors.New("connection does not exist")
 	}
 
-	return c.ws.Close()
+	c.closeOnce.Do(func() { close(c.stopChan) })
+
+	ws := c.currentWS()
+	if ws == nil {
+		return nil
+	}
+
+	return ws.Close()
 }
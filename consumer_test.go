@@ -11,6 +11,13 @@ import (
 	"time"
 //	"fmt"
 	"crypto/tls"
+	"bufio"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
 )
 
 type FakeHandler struct {
@@ -59,6 +66,93 @@ func (fh *FakeHandler) handle(conn *websocket.Conn) {
 	conn.Close()
 }
 
+type FakeRecentHandler struct {
+	Messages   []*logmessage.LogMessage
+	lastURL    string
+	authHeader string
+}
+
+func (fh *FakeRecentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fh.lastURL = r.URL.String()
+	fh.authHeader = r.Header.Get("Authorization")
+
+	writer := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/x-protobuf; boundary="+writer.Boundary())
+
+	for _, protoMessage := range fh.Messages {
+		part, err := writer.CreatePart(textproto.MIMEHeader{})
+		Expect(err).ToNot(HaveOccurred())
+
+		message, err := proto.Marshal(protoMessage)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = part.Write(message)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	writer.Close()
+}
+
+// fakeProxy is a minimal in-process HTTP CONNECT proxy, standing in for a
+// goproxy-backed one so the proxy tests don't need a real upstream proxy.
+type fakeProxy struct {
+	listener    net.Listener
+	connectHost string
+	authHeader  string
+}
+
+func newFakeProxy() *fakeProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	proxy := &fakeProxy{listener: listener}
+	go proxy.serve()
+
+	return proxy
+}
+
+func (p *fakeProxy) url() string {
+	return "http://" + p.listener.Addr().String()
+}
+
+func (p *fakeProxy) close() {
+	p.listener.Close()
+}
+
+func (p *fakeProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *fakeProxy) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	p.connectHost = request.Host
+	p.authHeader = request.Header.Get("Proxy-Authorization")
+
+	target, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	go io.Copy(target, reader)
+	io.Copy(conn, target)
+}
+
 func createMessage(message string) *logmessage.LogMessage{
 	messageType := logmessage.LogMessage_OUT
 	sourceName := "DEA"
@@ -128,13 +222,44 @@ var _ = Describe("Loggregator Consumer", func() {
 					close(done)
 				})
 
-				It("closes the channel after the server closes the connection", func(done Done) {
-					perform()
+				It("reconnects instead of closing the channel after the server closes the connection", func(done Done) {
+					connectCount := 0
+					reconnected := make(chan bool, 1)
+					connection = consumer.NewConnection(endpoint, tlsSettings, nil)
+					connection.SetOnConnectCallback(func() {
+						connectCount++
+						if connectCount == 2 {
+							reconnected <- true
+						}
+					})
+					incomingChan, errChan = connection.Tail(appGuid, authToken)
+
 					fakeHandler.closeConnection <- true
 
-					Eventually(errChan).Should(BeClosed())
-					Eventually(incomingChan).Should(BeClosed())
+					Eventually(reconnected, 5).Should(Receive())
+					Consistently(incomingChan).ShouldNot(BeClosed())
+					Consistently(errChan).ShouldNot(BeClosed())
+
+					fakeHandler.closeConnection <- true
+					connection.Close()
+
+					close(done)
+				}, 10)
+
+				It("fires the on-connect callback on every successful (re)connect", func(done Done) {
+					connectCount := 0
+					connected := make(chan bool, 2)
+					connection = consumer.NewConnection(endpoint, tlsSettings, nil)
+					connection.SetOnConnectCallback(func() {
+						connectCount++
+						connected <- true
+					})
+					incomingChan, errChan = connection.Tail(appGuid, authToken)
+
+					Eventually(connected).Should(Receive())
+					Expect(connectCount).To(Equal(1))
 
+					close(fakeHandler.closeConnection)
 					close(done)
 				})
 
@@ -198,6 +323,33 @@ var _ = Describe("Loggregator Consumer", func() {
 					close(done)
 				})
 			})
+
+			Context("when the server accepts the connection but never sends data", func() {
+				BeforeEach(func() {
+					consumer.ReadTimeout = 20 * time.Millisecond
+					testServer = httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+						<-fakeHandler.closeConnection
+						conn.Close()
+					}))
+					endpoint = testServer.Listener.Addr().String()
+				})
+
+				AfterEach(func() {
+					consumer.ReadTimeout = 30 * time.Second
+				})
+
+				It("reports ErrTimeout rather than blocking forever", func(done Done) {
+					perform()
+
+					err := <-errChan
+
+					Expect(err).To(Equal(consumer.ErrTimeout))
+
+					connection.Close()
+					close(fakeHandler.closeConnection)
+					close(done)
+				})
+			})
 		})
 
 		Context("when SSL settings are passed in", func() {
@@ -218,6 +370,215 @@ var _ = Describe("Loggregator Consumer", func() {
 		})
 	})
 
+	Describe("Proxy", func() {
+		var (
+			appGuid      string
+			authToken    string
+			incomingChan <-chan *logmessage.LogMessage
+			errChan      <-chan error
+			proxy        *fakeProxy
+			proxyFunc    func(*http.Request) (*url.URL, error)
+		)
+
+		perform := func() {
+			connection = consumer.NewConnection(endpoint, tlsSettings, proxyFunc)
+			incomingChan, errChan = connection.Tail(appGuid, authToken)
+		}
+
+		AfterEach(func() {
+			proxy.close()
+		})
+
+		Context("when the upstream is plain ws", func() {
+			BeforeEach(func() {
+				tlsSettings = nil
+				testServer = httptest.NewServer(websocket.Handler(fakeHandler.handle))
+				endpoint = testServer.Listener.Addr().String()
+
+				proxy = newFakeProxy()
+				proxyURL, err := url.Parse(proxy.url())
+				Expect(err).ToNot(HaveOccurred())
+				proxyFunc = func(*http.Request) (*url.URL, error) { return proxyURL, nil }
+			})
+
+			It("tunnels the websocket connection through the proxy", func(done Done) {
+				fakeHandler.Messages = []*logmessage.LogMessage{createMessage("hello")}
+				perform()
+
+				message := <-incomingChan
+
+				Expect(message.Message).To(Equal([]byte("hello")))
+				Expect(proxy.connectHost).To(Equal(endpoint))
+
+				close(fakeHandler.closeConnection)
+				close(done)
+			})
+		})
+
+		Context("when the upstream is TLS", func() {
+			BeforeEach(func() {
+				testServer = httptest.NewTLSServer(websocket.Handler(fakeHandler.handle))
+				endpoint = testServer.Listener.Addr().String()
+				tlsSettings = &tls.Config{InsecureSkipVerify: true}
+
+				proxy = newFakeProxy()
+				proxyURL, err := url.Parse(proxy.url())
+				Expect(err).ToNot(HaveOccurred())
+				proxyFunc = func(*http.Request) (*url.URL, error) { return proxyURL, nil }
+			})
+
+			It("tunnels the TLS websocket connection through the proxy", func(done Done) {
+				fakeHandler.Messages = []*logmessage.LogMessage{createMessage("hello")}
+				perform()
+
+				message := <-incomingChan
+
+				Expect(message.Message).To(Equal([]byte("hello")))
+				Expect(proxy.connectHost).To(Equal(endpoint))
+
+				close(fakeHandler.closeConnection)
+				close(done)
+			})
+		})
+
+		Context("when the proxy requires authentication", func() {
+			BeforeEach(func() {
+				tlsSettings = nil
+				testServer = httptest.NewServer(websocket.Handler(fakeHandler.handle))
+				endpoint = testServer.Listener.Addr().String()
+
+				proxy = newFakeProxy()
+				proxyURL, err := url.Parse(proxy.url())
+				Expect(err).ToNot(HaveOccurred())
+				proxyURL.User = url.UserPassword("user", "pass")
+				proxyFunc = func(*http.Request) (*url.URL, error) { return proxyURL, nil }
+			})
+
+			It("propagates the proxy credentials on the CONNECT request", func(done Done) {
+				perform()
+
+				Eventually(func() string { return proxy.authHeader }).ShouldNot(BeEmpty())
+				Expect(proxy.authHeader).To(Equal("Basic dXNlcjpwYXNz"))
+
+				close(fakeHandler.closeConnection)
+				close(done)
+			})
+		})
+	})
+
+	Describe("Recent", func() {
+		var (
+			appGuid       string
+			authToken     string
+			recentHandler *FakeRecentHandler
+		)
+
+		perform := func() {
+			connection = consumer.NewConnection(endpoint, tlsSettings, nil)
+		}
+
+		BeforeEach(func() {
+			tlsSettings = nil
+			recentHandler = &FakeRecentHandler{}
+			testServer = httptest.NewServer(recentHandler)
+			endpoint = testServer.Listener.Addr().String()
+		})
+
+		It("requests the /recent endpoint for the given app", func() {
+			appGuid = "app-guid"
+			recentHandler.Messages = []*logmessage.LogMessage{createMessage("hello")}
+			perform()
+
+			messages, err := connection.Recent(appGuid, authToken)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(recentHandler.lastURL).To(ContainSubstring("/recent?app=app-guid"))
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Message).To(Equal([]byte("hello")))
+		})
+
+		It("sends an Authorization header with an access token", func() {
+			authToken = "auth-token"
+			perform()
+
+			_, err := connection.Recent(appGuid, authToken)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(recentHandler.authHeader).To(Equal("auth-token"))
+		})
+	})
+
+	Describe("TailFiltered", func() {
+		var (
+			appGuid      string
+			authToken    string
+			incomingChan <-chan *logmessage.LogMessage
+			errChan      <-chan error
+			filter       consumer.Filter
+		)
+
+		perform := func() {
+			connection = consumer.NewConnection(endpoint, tlsSettings, nil)
+			incomingChan, errChan = connection.TailFiltered(appGuid, authToken, filter)
+		}
+
+		BeforeEach(func() {
+			tlsSettings = nil
+			filter = consumer.Filter{}
+			testServer = httptest.NewServer(websocket.Handler(fakeHandler.handle))
+			endpoint = testServer.Listener.Addr().String()
+		})
+
+		It("only delivers messages matching the message type filter", func(done Done) {
+			errMessageType := logmessage.LogMessage_ERR
+			errMessage := createMessage("uh oh")
+			errMessage.MessageType = &errMessageType
+
+			fakeHandler.Messages = []*logmessage.LogMessage{createMessage("hello"), errMessage}
+			filter = consumer.Filter{MessageTypes: []logmessage.LogMessage_MessageType{logmessage.LogMessage_ERR}}
+			perform()
+
+			message := <-incomingChan
+			Expect(message.Message).To(Equal([]byte("uh oh")))
+
+			close(fakeHandler.closeConnection)
+			close(done)
+		})
+
+		It("only delivers messages from the given source names and propagates source_type", func(done Done) {
+			fakeHandler.Messages = []*logmessage.LogMessage{createMessage("hello")}
+			filter = consumer.Filter{SourceNames: []string{"DEA"}}
+			perform()
+
+			message := <-incomingChan
+			Expect(message.Message).To(Equal([]byte("hello")))
+			Expect(fakeHandler.lastURL).To(ContainSubstring("source_type=DEA"))
+
+			close(fakeHandler.closeConnection)
+			close(done)
+		})
+
+		It("only delivers messages from the given source instance index", func(done Done) {
+			otherInstance := "1"
+			matchingInstance := "0"
+
+			matchingMessage := createMessage("match")
+			matchingMessage.SourceId = proto.String(matchingInstance)
+			otherMessage := createMessage("no match")
+			otherMessage.SourceId = &otherInstance
+
+			fakeHandler.Messages = []*logmessage.LogMessage{otherMessage, matchingMessage}
+			filter = consumer.Filter{SourceInstance: &matchingInstance}
+			perform()
+
+			message := <-incomingChan
+			Expect(message.Message).To(Equal([]byte("match")))
+
+			close(fakeHandler.closeConnection)
+			close(done)
+		})
+	})
+
 	Describe("Close", func() {
 		BeforeEach(func() {
 			testServer = httptest.NewServer(websocket.Handler(fakeHandler.handle))